@@ -0,0 +1,2212 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed under the Cockroach Community Licence (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/ccl/LICENSE
+
+package storageccl
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	azureblob "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/rlmcpherson/s3gof3r"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// Parameter names for the S3 bucket URL, both accepted as query
+// parameters on the URL and as environment variables (with the prefix
+// AWS_).
+const (
+	S3AccessKeyParam = "AWS_ACCESS_KEY_ID"
+	S3SecretParam    = "AWS_SECRET_ACCESS_KEY"
+)
+
+// s3EndpointParam and s3ForcePathStyleParam let an s3:// URI point at an
+// S3-compatible service other than AWS (e.g. a MinIO or Ceph/RGW
+// deployment) rather than always talking to AWS's own endpoints.
+const s3EndpointParam = "AWS_ENDPOINT"
+const s3ForcePathStyleParam = "AWS_S3_FORCE_PATH_STYLE"
+
+const gsDefaultKey = "GOOGLE_APPLICATION_CREDENTIALS"
+
+const azureAccountNameParam = "AZURE_ACCOUNT_NAME"
+const azureAccountKeyParam = "AZURE_ACCOUNT_KEY"
+
+// ExportStorage provides functions to read and write files in some storage,
+// namely various cloud storage providers and local file storage, for bulk
+// I/O during backup and restore.
+type ExportStorage interface {
+	// Conf should return the serializable configuration required to
+	// reconstruct this ExportStorage implementation.
+	Conf() roachpb.ExportStorage
+
+	// ReadFile returns a Reader for the requested name.
+	ReadFile(ctx context.Context, basename string) (io.ReadCloser, error)
+
+	// ReadFileAt returns a Reader for basename starting at offset and
+	// reading at most length bytes, or to the end of the file if length is
+	// negative. The returned reader transparently resumes the read, via a
+	// new request starting at the last byte delivered, if it hits a
+	// transient network error, so RESTORE can stream multi-GiB SSTs without
+	// surfacing every TCP hiccup to the caller.
+	ReadFileAt(ctx context.Context, basename string, offset, length int64) (io.ReadCloser, error)
+
+	// PutFile returns a writer that stages a local copy of basename's
+	// contents, which is uploaded to the destination when Finish is called on
+	// the returned ExportStorageWriter.
+	PutFile(ctx context.Context, basename string) (ExportStorageWriter, error)
+
+	// Writer returns a writer that streams its writes directly to basename,
+	// without staging them in a local file first. For the cloud providers
+	// this is backed by their native chunked/multipart upload APIs, so it
+	// avoids both the extra local disk usage and the latency of writing the
+	// whole file before the upload can start that PutFile incurs. Closing the
+	// returned writer completes (or aborts, on error) the upload; canceling
+	// ctx aborts an in-progress upload and best-effort cleans up any storage
+	// it had already consumed.
+	Writer(ctx context.Context, basename string) (io.WriteCloser, error)
+
+	// Delete removes the named file from the store.
+	Delete(ctx context.Context, basename string) error
+
+	// List returns the basenames of every file in the store whose name
+	// begins with prefix, discovering prior or partial backup contents
+	// without the caller having to already know every name in it.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// DeletePrefix removes every file in the store whose name begins with
+	// prefix, for bulk cleanup of a backup's contents (e.g. for a DROP
+	// BACKUP style GC) without enumerating every name individually.
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// Close releases resources held by the ExportStorage.
+	Close() error
+}
+
+// ExportStorageWriter is returned by ExportStorage.PutFile. The caller
+// writes the content to be stored to the local file named by LocalFile,
+// and then calls Finish to upload it (or Cleanup to discard it without
+// uploading).
+type ExportStorageWriter interface {
+	// LocalFile returns the path to a local file to which the caller should
+	// write the content that is to be stored.
+	LocalFile() string
+	// Finish uploads the current content of LocalFile and removes it. It is
+	// an error to write to LocalFile after calling Finish.
+	Finish() error
+	// Cleanup removes LocalFile without uploading it. It is safe to call
+	// after Finish has already succeeded and should be deferred immediately
+	// after a successful call to PutFile.
+	Cleanup()
+}
+
+const maxReadRetries = 3
+
+// isResumableReadErr reports whether err, encountered while streaming a
+// ReadFileAt response, is the kind of transient network failure that
+// re-issuing the request for the remaining bytes can recover from.
+func isResumableReadErr(err error) bool {
+	if err == nil || err == io.EOF {
+		return false
+	}
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+func readRetryBackoff(attempt int) time.Duration {
+	return time.Duration(attempt) * 100 * time.Millisecond
+}
+
+// resumingReader wraps the ReadCloser returned by open(ctx, offset) and, on
+// a resumable error, transparently closes it and reopens the stream at
+// offset+bytesDelivered, up to maxReadRetries times in a row (the count
+// resets after each error-free read that delivers data), so callers see a
+// single uninterrupted stream across transient network errors.
+type resumingReader struct {
+	ctx     context.Context
+	open    func(ctx context.Context, pos int64) (io.ReadCloser, error)
+	cur     io.ReadCloser
+	pos     int64
+	retries int
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			rc, err := r.open(r.ctx, r.pos)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rc
+		}
+		n, err := r.cur.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF {
+			if n > 0 {
+				r.retries = 0
+			}
+			return n, err
+		}
+		if !isResumableReadErr(err) || r.retries >= maxReadRetries {
+			return n, err
+		}
+		r.cur.Close()
+		r.cur = nil
+		r.retries++
+		time.Sleep(readRetryBackoff(r.retries))
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
+
+// rangeHeader formats an HTTP Range header value for [offset, offset+length),
+// or an open-ended range starting at offset if length is negative.
+func rangeHeader(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// limitedReadCloser adapts an io.Reader and io.Closer pair, such as an
+// os.File wrapped in an io.LimitReader, into a single io.ReadCloser.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Defaults for the cloud providers' parallel multipart upload path, used
+// whenever the caller doesn't override them via the destination config's own
+// PartSizeBytes/Concurrency (ExportStorage_S3, ExportStorage_GCS, and
+// ExportStorage_Azure each carry their own copy of these fields).
+const (
+	defaultPartSizeBytes   = 32 * 1024 * 1024
+	defaultPartConcurrency = 4
+)
+
+// multipartSettings returns the part size and worker pool size a PutFile
+// implementation should use for its multipart uploads, falling
+// back to the package defaults when the destination config's PartSizeBytes
+// and/or Concurrency are left unset (zero).
+func multipartSettings(partSizeBytes int64, concurrency int32) (partSize int64, workers int) {
+	partSize, workers = defaultPartSizeBytes, defaultPartConcurrency
+	if partSizeBytes > 0 {
+		partSize = partSizeBytes
+	}
+	if concurrency > 0 {
+		workers = int(concurrency)
+	}
+	return partSize, workers
+}
+
+// uploadPartsConcurrently splits [0, size) into fixed-size parts and calls
+// uploadPart for each, through a worker pool bounded by concurrency. A
+// failed part does not stop the others: every part is still attempted and
+// waited for, so that by the time it returns an error, the caller can
+// reliably clean up every part that did get uploaded. If several parts
+// fail, it returns the error of the lowest-numbered one.
+func uploadPartsConcurrently(
+	ctx context.Context,
+	size, partSize int64,
+	concurrency int,
+	uploadPart func(ctx context.Context, partIndex int, offset, length int64) error,
+) error {
+	if size == 0 {
+		return uploadPart(ctx, 0, 0, 0)
+	}
+	numParts := int((size + partSize - 1) / partSize)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	errs := make([]error, numParts)
+	for i := 0; i < numParts; i++ {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, offset, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = uploadPart(ctx, i, offset, length)
+		}(i, offset, length)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	clientEncryptionChunkSize   = 64 * 1024
+	clientEncryptionSaltLen     = 16
+	clientEncryptionPBKDF2Iters = 100000
+)
+
+var clientEncryptionMagic = [4]byte{'C', 'R', 'D', 'B'}
+
+const clientEncryptionVersion = 1
+
+// deriveClientEncryptionKeys derives the AES-256 key used to encrypt chunks
+// and a separate key used to authenticate the file header, from either a
+// raw key or a passphrase. salt defends against precomputed dictionary
+// attacks on the passphrase and, since it isn't secret, is stored in the
+// file header so the same salt is used again on decryption.
+func deriveClientEncryptionKeys(
+	enc *roachpb.ExportStorageEncryption, salt []byte,
+) (aesKey, macKey []byte) {
+	base := enc.Key
+	if len(base) == 0 {
+		base = pbkdf2.Key([]byte(enc.Passphrase), salt, clientEncryptionPBKDF2Iters, 32, sha256.New)
+	}
+	aesMAC := hmac.New(sha256.New, base)
+	aesMAC.Write([]byte("aes"))
+	macMAC := hmac.New(sha256.New, base)
+	macMAC.Write([]byte("mac"))
+	return aesMAC.Sum(nil), macMAC.Sum(nil)
+}
+
+// clientEncryptingWriter encrypts plaintext with AES-GCM in fixed-size
+// chunks, each with its own nonce, before passing the ciphertext to dst.
+// The leading header (magic, version, salt) is authenticated with an
+// HMAC so a corrupted or wrong-key header is rejected up front instead of
+// surfacing as confusing per-chunk decryption failures.
+type clientEncryptingWriter struct {
+	dst   io.WriteCloser
+	gcm   cipher.AEAD
+	buf   bytes.Buffer
+	chunk uint64
+}
+
+func newClientEncryptingWriter(
+	dst io.WriteCloser, enc *roachpb.ExportStorageEncryption,
+) (io.WriteCloser, error) {
+	salt := make([]byte, clientEncryptionSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aesKey, macKey := deriveClientEncryptionKeys(enc, salt)
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, len(clientEncryptionMagic)+1+len(salt))
+	hdr = append(hdr, clientEncryptionMagic[:]...)
+	hdr = append(hdr, clientEncryptionVersion)
+	hdr = append(hdr, salt...)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(hdr)
+	hdr = append(hdr, mac.Sum(nil)...)
+	if _, err := dst.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &clientEncryptingWriter{dst: dst, gcm: gcm}, nil
+}
+
+func (w *clientEncryptingWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= clientEncryptionChunkSize {
+		if err := w.flushChunk(w.buf.Next(clientEncryptionChunkSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *clientEncryptingWriter) flushChunk(plaintext []byte) error {
+	nonce := make([]byte, w.gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[:8], w.chunk)
+	if _, err := rand.Read(nonce[8:]); err != nil {
+		return err
+	}
+	ciphertext := w.gcm.Seal(nil, nonce, plaintext, nil)
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(ciphertext)))
+	if _, err := w.dst.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(nonce); err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(ciphertext); err != nil {
+		return err
+	}
+	w.chunk++
+	return nil
+}
+
+func (w *clientEncryptingWriter) Close() error {
+	if w.buf.Len() > 0 {
+		if err := w.flushChunk(w.buf.Bytes()); err != nil {
+			w.dst.Close()
+			return err
+		}
+	}
+	return w.dst.Close()
+}
+
+// clientDecryptingReader is the counterpart to clientEncryptingWriter: it
+// validates the header MAC, then decrypts each chunk as it is consumed.
+type clientDecryptingReader struct {
+	src     io.ReadCloser
+	gcm     cipher.AEAD
+	pending []byte
+	chunk   uint64
+}
+
+func newClientDecryptingReader(
+	src io.ReadCloser, enc *roachpb.ExportStorageEncryption,
+) (io.ReadCloser, error) {
+	hdr := make([]byte, len(clientEncryptionMagic)+1+clientEncryptionSaltLen)
+	if _, err := io.ReadFull(src, hdr); err != nil {
+		src.Close()
+		return nil, errors.Wrap(err, "reading encryption header")
+	}
+	if !bytes.Equal(hdr[:len(clientEncryptionMagic)], clientEncryptionMagic[:]) {
+		src.Close()
+		return nil, errors.New("not a client-side-encrypted file (bad magic)")
+	}
+	salt := hdr[len(clientEncryptionMagic)+1:]
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(src, mac); err != nil {
+		src.Close()
+		return nil, errors.Wrap(err, "reading encryption header MAC")
+	}
+	aesKey, macKey := deriveClientEncryptionKeys(enc, salt)
+	expected := hmac.New(sha256.New, macKey)
+	expected.Write(hdr)
+	if !hmac.Equal(mac, expected.Sum(nil)) {
+		src.Close()
+		return nil, errors.New("wrong decryption key, or file is corrupt")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &clientDecryptingReader{src: src, gcm: gcm}, nil
+}
+
+func (r *clientDecryptingReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r.src, lenBuf[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		nonce := make([]byte, r.gcm.NonceSize())
+		if _, err := io.ReadFull(r.src, nonce); err != nil {
+			return 0, errors.Wrap(err, "reading chunk nonce")
+		}
+		ciphertext := make([]byte, n)
+		if _, err := io.ReadFull(r.src, ciphertext); err != nil {
+			return 0, errors.Wrap(err, "reading chunk ciphertext")
+		}
+		plaintext, err := r.gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "decrypting chunk, wrong key?")
+		}
+		r.pending = plaintext
+		r.chunk++
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *clientDecryptingReader) Close() error {
+	return r.src.Close()
+}
+
+// encryptedPutFileWriter stages a local plaintext copy, same as the other
+// PutFile implementations, but on Finish streams it through a
+// clientEncryptingWriter into inner's Writer rather than inner's own
+// PutFile, so every provider's buffered upload path gets client-side
+// encryption for free.
+type encryptedPutFileWriter struct {
+	ctx      context.Context
+	tmp      string
+	basename string
+	inner    ExportStorage
+	enc      *roachpb.ExportStorageEncryption
+	cleanup  func()
+}
+
+func (w *encryptedPutFileWriter) LocalFile() string { return w.tmp }
+
+func (w *encryptedPutFileWriter) Finish() error {
+	f, err := os.Open(w.tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dst, err := w.inner.Writer(w.ctx, w.basename)
+	if err != nil {
+		return err
+	}
+	ew, err := newClientEncryptingWriter(dst, w.enc)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := io.Copy(ew, f); err != nil {
+		ew.Close()
+		return err
+	}
+	return ew.Close()
+}
+
+func (w *encryptedPutFileWriter) Cleanup() {
+	w.cleanup()
+}
+
+// clientEncryptedStorage wraps an ExportStorage so that writes are
+// transparently encrypted with AES-GCM before being handed to the
+// underlying provider, and reads are transparently decrypted, so that the
+// ciphertext the provider ever stores or serves is opaque to it.
+type clientEncryptedStorage struct {
+	ExportStorage
+	enc *roachpb.ExportStorageEncryption
+}
+
+// Conf reports the Encryption the caller configured, since the wrapped
+// ExportStorage has no notion of client-side encryption to include it in
+// its own Conf.
+func (c *clientEncryptedStorage) Conf() roachpb.ExportStorage {
+	conf := c.ExportStorage.Conf()
+	conf.Encryption = c.enc
+	return conf
+}
+
+func (c *clientEncryptedStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	w, err := c.ExportStorage.Writer(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	return newClientEncryptingWriter(w, c.enc)
+}
+
+func (c *clientEncryptedStorage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp, err := ioutil.TempFile("", "export-storage-encrypt")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	return &encryptedPutFileWriter{
+		ctx:      ctx,
+		tmp:      tmp.Name(),
+		basename: basename,
+		inner:    c.ExportStorage,
+		enc:      c.enc,
+		cleanup:  func() { _ = os.Remove(tmp.Name()) },
+	}, nil
+}
+
+func (c *clientEncryptedStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, err := c.ExportStorage.ReadFile(ctx, basename)
+	if err != nil {
+		return nil, err
+	}
+	return newClientDecryptingReader(r, c.enc)
+}
+
+func (c *clientEncryptedStorage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	// The chunked AES-GCM framing means an arbitrary byte offset doesn't
+	// correspond to any single ciphertext offset, so encrypted files are
+	// always read from the start; offset/length are then applied to the
+	// decrypted plaintext stream.
+	r, err := c.ExportStorage.ReadFileAt(ctx, basename, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := newClientDecryptingReader(r, c.enc)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, dr, offset); err != nil {
+			dr.Close()
+			return nil, errors.Wrap(err, "skipping to offset in decrypted stream")
+		}
+	}
+	if length < 0 {
+		return dr, nil
+	}
+	return limitedReadCloser{Reader: io.LimitReader(dr, length), Closer: dr}, nil
+}
+
+// validateEncryptionMode returns an error if dest.Encryption requests a
+// server-side encryption mode the destination's provider has no way to
+// honor, so a misconfigured destination fails loudly instead of silently
+// uploading unencrypted (or partially encrypted) data.
+func validateEncryptionMode(provider roachpb.ExportStorageProvider, enc *roachpb.ExportStorageEncryption) error {
+	if enc == nil {
+		return nil
+	}
+	switch enc.Mode {
+	case roachpb.ExportStorageEncryption_ClientAESGCM:
+		// Applied uniformly on top of every provider by clientEncryptedStorage.
+	case roachpb.ExportStorageEncryption_SSE_S3:
+		if provider != roachpb.ExportStorageProvider_S3 {
+			return errors.Errorf("SSE_S3 encryption is only supported for S3 destinations, not %s", provider)
+		}
+	case roachpb.ExportStorageEncryption_SSE_KMS:
+		switch provider {
+		case roachpb.ExportStorageProvider_S3:
+		case roachpb.ExportStorageProvider_GoogleCloud:
+			if enc.KMSKeyID == "" {
+				return errors.New("SSE_KMS encryption for GoogleCloud destinations requires a KMSKeyID")
+			}
+		case roachpb.ExportStorageProvider_Azure:
+			// Azure has no KMS-key-ID-based SSE; SSE_KMS against Azure is
+			// instead taken to mean customer-provided-key encryption, which
+			// needs the raw key rather than a KMS key ID.
+			if len(enc.Key) == 0 {
+				return errors.New("SSE_KMS encryption for Azure destinations requires a Key, not a KMSKeyID")
+			}
+		default:
+			return errors.Errorf("SSE_KMS encryption is not supported for %s destinations", provider)
+		}
+	default:
+		return errors.Errorf("unsupported encryption mode: %s", enc.Mode)
+	}
+	return nil
+}
+
+// MakeExportStorage creates an ExportStorage from the given config.
+func MakeExportStorage(ctx context.Context, dest roachpb.ExportStorage) (ExportStorage, error) {
+	if err := validateEncryptionMode(dest.Provider, dest.Encryption); err != nil {
+		return nil, err
+	}
+	var s ExportStorage
+	var err error
+	switch dest.Provider {
+	case roachpb.ExportStorageProvider_LocalFile:
+		s, err = makeLocalStorage(dest.LocalFile.Path)
+	case roachpb.ExportStorageProvider_Http:
+		s, err = makeHTTPStorage(dest.HttpPath.BaseUri)
+	case roachpb.ExportStorageProvider_S3:
+		s, err = makeS3Storage(ctx, dest.S3Config, dest.Encryption)
+	case roachpb.ExportStorageProvider_GoogleCloud:
+		s, err = makeGCSStorage(ctx, dest.GoogleCloudConfig, dest.Encryption)
+	case roachpb.ExportStorageProvider_Azure:
+		s, err = makeAzureStorage(dest.AzureConfig, dest.Encryption)
+	default:
+		return nil, errors.Errorf("unsupported export destination type: %s", dest.Provider.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// SSE-S3/SSE-KMS/CPK are wired directly into each provider's PUT and GET
+	// paths above, since the provider itself does the encrypting/decrypting.
+	// Client-side encryption, by contrast, needs the ciphertext to be opaque
+	// to the provider, so it's layered on top here instead, uniformly for
+	// every provider.
+	if dest.Encryption != nil && dest.Encryption.Mode == roachpb.ExportStorageEncryption_ClientAESGCM {
+		s = &clientEncryptedStorage{ExportStorage: s, enc: dest.Encryption}
+	}
+	return s, nil
+}
+
+// ExportStorageURLOpener constructs an ExportStorage from a parsed URI whose
+// scheme it was registered for.
+type ExportStorageURLOpener func(ctx context.Context, uri *url.URL) (ExportStorage, error)
+
+var exportStorageProviders = struct {
+	syncutil.Mutex
+	openers map[string]ExportStorageURLOpener
+}{openers: make(map[string]ExportStorageURLOpener)}
+
+// RegisterProvider registers an ExportStorageURLOpener for scheme, so that
+// ExportStorageFromURI can construct an ExportStorage for URIs using it. It
+// is intended to be called from the init function of a package providing an
+// out-of-tree ExportStorage implementation (e.g. for a storage service not
+// built into this package, such as Swift or an S3-compatible service with
+// its own bespoke auth). It panics if scheme is already registered.
+func RegisterProvider(scheme string, opener ExportStorageURLOpener) {
+	exportStorageProviders.Lock()
+	defer exportStorageProviders.Unlock()
+	if _, ok := exportStorageProviders.openers[scheme]; ok {
+		panic(fmt.Sprintf("storage provider already registered for scheme %q", scheme))
+	}
+	exportStorageProviders.openers[scheme] = opener
+}
+
+func lookupProvider(scheme string) (ExportStorageURLOpener, bool) {
+	exportStorageProviders.Lock()
+	defer exportStorageProviders.Unlock()
+	opener, ok := exportStorageProviders.openers[scheme]
+	return opener, ok
+}
+
+func init() {
+	RegisterProvider("nodelocal", openLocalFileStorage)
+	RegisterProvider("", openLocalFileStorage)
+	RegisterProvider("http", openHTTPStorage)
+	RegisterProvider("https", openHTTPStorage)
+	RegisterProvider("s3", openS3Storage)
+	RegisterProvider("gs", openGCSStorage)
+	RegisterProvider("azure", openAzureStorage)
+}
+
+func openLocalFileStorage(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+	return makeLocalStorage(uri.Path)
+}
+
+func openHTTPStorage(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+	return makeHTTPStorage(uri.String())
+}
+
+func openS3Storage(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+	conf := &roachpb.ExportStorage_S3{
+		Bucket:           uri.Host,
+		Prefix:           uri.Path,
+		AccessKey:        uri.Query().Get(S3AccessKeyParam),
+		Secret:           uri.Query().Get(S3SecretParam),
+		Endpoint:         uri.Query().Get(s3EndpointParam),
+		S3ForcePathStyle: uri.Query().Get(s3ForcePathStyleParam) != "",
+	}
+	return makeS3Storage(ctx, conf, nil)
+}
+
+func openGCSStorage(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+	conf := &roachpb.ExportStorage_GCS{
+		Bucket: uri.Host,
+		Prefix: uri.Path,
+	}
+	return makeGCSStorage(ctx, conf, nil)
+}
+
+func openAzureStorage(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+	conf := &roachpb.ExportStorage_Azure{
+		Container:   uri.Host,
+		Prefix:      uri.Path,
+		AccountName: uri.Query().Get(azureAccountNameParam),
+		AccountKey:  uri.Query().Get(azureAccountKeyParam),
+	}
+	return makeAzureStorage(conf, nil)
+}
+
+// ExportStorageConfFromURI parses a URI into a structured configuration
+// object that can later be passed to MakeExportStorage to instantiate the
+// storage implementation it describes.
+func ExportStorageConfFromURI(path string) (roachpb.ExportStorage, error) {
+	conf := roachpb.ExportStorage{}
+	uri, err := url.Parse(path)
+	if err != nil {
+		return conf, err
+	}
+	switch uri.Scheme {
+	case "http", "https":
+		conf.Provider = roachpb.ExportStorageProvider_Http
+		conf.HttpPath.BaseUri = path
+	case "s3":
+		conf.Provider = roachpb.ExportStorageProvider_S3
+		conf.S3Config = &roachpb.ExportStorage_S3{
+			Bucket:           uri.Host,
+			Prefix:           uri.Path,
+			AccessKey:        uri.Query().Get(S3AccessKeyParam),
+			Secret:           uri.Query().Get(S3SecretParam),
+			Endpoint:         uri.Query().Get(s3EndpointParam),
+			S3ForcePathStyle: uri.Query().Get(s3ForcePathStyleParam) != "",
+		}
+	case "gs":
+		conf.Provider = roachpb.ExportStorageProvider_GoogleCloud
+		conf.GoogleCloudConfig = &roachpb.ExportStorage_GCS{
+			Bucket: uri.Host,
+			Prefix: uri.Path,
+		}
+	case "azure":
+		conf.Provider = roachpb.ExportStorageProvider_Azure
+		conf.AzureConfig = &roachpb.ExportStorage_Azure{
+			Container:   uri.Host,
+			Prefix:      uri.Path,
+			AccountName: uri.Query().Get(azureAccountNameParam),
+			AccountKey:  uri.Query().Get(azureAccountKeyParam),
+		}
+	case "nodelocal", "":
+		conf.Provider = roachpb.ExportStorageProvider_LocalFile
+		conf.LocalFile.Path = uri.Path
+	default:
+		return conf, errors.Errorf("unsupported storage scheme: %q", uri.Scheme)
+	}
+	return conf, nil
+}
+
+// ExportStorageFromURI parses a URI and creates an ExportStorage for it,
+// dispatching on uri.Scheme through the provider registry. This is distinct
+// from going through ExportStorageConfFromURI and MakeExportStorage: that
+// path produces a roachpb.ExportStorage, which is what gets persisted in
+// BACKUP/RESTORE job state so a different node can resume the job, and so is
+// necessarily limited to providers the proto has a case for. Providers
+// registered out-of-tree via RegisterProvider have no such proto
+// representation, so they're only reachable here, for uses (like ad hoc
+// SHOW BACKUP) that just need an ExportStorage for the lifetime of the
+// current process.
+func ExportStorageFromURI(ctx context.Context, path string) (ExportStorage, error) {
+	uri, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	opener, ok := lookupProvider(uri.Scheme)
+	if !ok {
+		return nil, errors.Errorf("unsupported storage scheme: %q", uri.Scheme)
+	}
+	return opener(ctx, uri)
+}
+
+// localFileWriter stages writes to a temp file in a node-local directory,
+// moving it into place under its final name on Finish.
+type localFileWriter struct {
+	tmp, final string
+}
+
+func (w *localFileWriter) LocalFile() string { return w.tmp }
+
+func (w *localFileWriter) Finish() error {
+	return os.Rename(w.tmp, w.final)
+}
+
+func (w *localFileWriter) Cleanup() {
+	_ = os.Remove(w.tmp)
+}
+
+type localFileStorage struct {
+	base string
+}
+
+func makeLocalStorage(base string) (ExportStorage, error) {
+	if base == "" {
+		return nil, errors.New("LocalFile storage requires a base path")
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating local export storage base")
+	}
+	return &localFileStorage{base: base}, nil
+}
+
+func (l *localFileStorage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{
+		Provider:  roachpb.ExportStorageProvider_LocalFile,
+		LocalFile: roachpb.ExportStorage_LocalFilePath{Path: l.base},
+	}
+}
+
+func (l *localFileStorage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp := filepath.Join(l.base, basename+".tmp")
+	return &localFileWriter{tmp: tmp, final: filepath.Join(l.base, basename)}, nil
+}
+
+// Writer opens basename directly: the local provider never needed the
+// temp-file staging in the first place, so it streams writes straight to
+// the destination file.
+func (l *localFileStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(l.base, basename))
+}
+
+func (l *localFileStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.base, basename))
+}
+
+func (l *localFileStorage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(l.base, basename))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (l *localFileStorage) Delete(ctx context.Context, basename string) error {
+	return os.Remove(filepath.Join(l.base, basename))
+}
+
+func (l *localFileStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(l.base, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.base, p)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(rel, prefix) {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing local export storage")
+	}
+	return names, nil
+}
+
+func (l *localFileStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := l.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := l.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*localFileStorage) Close() error {
+	return nil
+}
+
+// httpFileWriter stages a file locally and PUTs it to an HTTP endpoint on
+// Finish.
+type httpFileWriter struct {
+	ctx     context.Context
+	tmp     string
+	dest    string
+	cleanup func()
+}
+
+func (w *httpFileWriter) LocalFile() string { return w.tmp }
+
+func (w *httpFileWriter) Finish() error {
+	f, err := os.Open(w.tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("PUT", w.dest, f)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(w.ctx)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("failed to PUT to %s: %s", w.dest, resp.Status)
+	}
+	return nil
+}
+
+func (w *httpFileWriter) Cleanup() {
+	w.cleanup()
+}
+
+type httpStorage struct {
+	base string
+}
+
+func makeHTTPStorage(base string) (ExportStorage, error) {
+	if base == "" {
+		return nil, errors.New("HTTP storage requires a base URI")
+	}
+	return &httpStorage{base: base}, nil
+}
+
+func (h *httpStorage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: h.base},
+	}
+}
+
+func (h *httpStorage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp, err := ioutil.TempFile("", "export-storage-http")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	return &httpFileWriter{
+		ctx:     ctx,
+		tmp:     tmp.Name(),
+		dest:    h.base + basename,
+		cleanup: func() { _ = os.Remove(tmp.Name()) },
+	}, nil
+}
+
+// pipeWriteCloser pumps writes through an io.Pipe to a goroutine performing
+// the actual upload, and surfaces that goroutine's result (or a context
+// cancellation) from Close.
+type pipeWriteCloser struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (p *pipeWriteCloser) Write(b []byte) (int, error) { return p.pw.Write(b) }
+
+func (p *pipeWriteCloser) Close() error {
+	if err := p.pw.Close(); err != nil {
+		return err
+	}
+	return <-p.done
+}
+
+func (h *httpStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	req, err := http.NewRequest("PUT", h.base+basename, pr)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			err := errors.Errorf("failed to PUT to %s: %s", h.base+basename, resp.Status)
+			pr.CloseWithError(err)
+			done <- err
+			return
+		}
+		done <- nil
+	}()
+	return &pipeWriteCloser{pw: pw, done: done}, nil
+}
+
+func (h *httpStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", h.base+basename, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, errors.Errorf("GET %s failed: %s", h.base+basename, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (h *httpStorage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	open := func(ctx context.Context, pos int64) (io.ReadCloser, error) {
+		req, err := http.NewRequest("GET", h.base+basename, nil)
+		if err != nil {
+			return nil, err
+		}
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - (pos - offset)
+		}
+		req.Header.Set("Range", rangeHeader(pos, remaining))
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.Errorf("GET %s failed: %s", h.base+basename, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return &resumingReader{ctx: ctx, open: open, pos: offset}, nil
+}
+
+func (h *httpStorage) Delete(ctx context.Context, basename string) error {
+	req, err := http.NewRequest("DELETE", h.base+basename, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("DELETE %s failed: %s", h.base+basename, resp.Status)
+	}
+	return nil
+}
+
+// davMultistatus is the subset of a WebDAV PROPFIND response this provider
+// needs: just enough to recover each listed resource's name.
+type davMultistatus struct {
+	XMLName   xml.Name `xml:"multistatus"`
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+// hrefPattern extracts anchor targets from an HTML directory listing, as
+// served by a plain static file server (e.g. nginx's autoindex or Python's
+// http.server) that doesn't understand WebDAV's PROPFIND.
+var hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+// List tries a WebDAV PROPFIND first, since it gives an exact listing, and
+// falls back to scraping an HTML directory index if the server doesn't
+// support it.
+func (h *httpStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	req, err := http.NewRequest("PROPFIND", h.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusMultiStatus {
+			var ms davMultistatus
+			if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+				return nil, errors.Wrap(err, "parsing PROPFIND response")
+			}
+			var names []string
+			for _, r := range ms.Responses {
+				name := path.Base(r.Href)
+				if strings.HasPrefix(name, prefix) {
+					names = append(names, name)
+				}
+			}
+			return names, nil
+		}
+	}
+	return h.listFromIndex(ctx, prefix)
+}
+
+func (h *httpStorage) listFromIndex(ctx context.Context, prefix string) ([]string, error) {
+	req, err := http.NewRequest("GET", h.base, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("listing %s failed: %s", h.base, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range hrefPattern.FindAllStringSubmatch(string(body), -1) {
+		name := m[1]
+		if strings.Contains(name, "://") || strings.HasSuffix(name, "/") {
+			continue
+		}
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (h *httpStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := h.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := h.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*httpStorage) Close() error {
+	return nil
+}
+
+// s3FileWriter stages a file locally, uploading it to S3 on Finish. Files
+// larger than a single part, when the concurrency is above one, are uploaded
+// as a multipart upload, with parts uploaded in parallel through a worker
+// pool; other files are streamed through a single s3gof3r PutWriter.
+type s3FileWriter struct {
+	ctx              context.Context
+	tmp, bucket, key string
+	s3               *s3gof3r.Bucket
+	svc              *s3.S3
+	sseHeaders       http.Header
+	partSize         int64
+	concurrency      int
+	cleanup          func()
+}
+
+func (w *s3FileWriter) LocalFile() string { return w.tmp }
+
+func (w *s3FileWriter) Finish() error {
+	f, err := os.Open(w.tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= w.partSize || w.concurrency <= 1 {
+		wc, err := w.s3.PutWriter(w.key, w.sseHeaders, nil)
+		if err != nil {
+			return errors.Wrap(err, "initiating S3 upload")
+		}
+		if _, err := io.Copy(wc, f); err != nil {
+			wc.Close()
+			return errors.Wrap(err, "uploading to S3")
+		}
+		return wc.Close()
+	}
+	return uploadS3Multipart(w.ctx, w.svc, w.bucket, w.key, f, info.Size(), w.partSize, w.concurrency, w.sseHeaders)
+}
+
+// sseSDKParams translates the gof3r-style SSE headers set by sseHeaders into
+// the typed fields the aws-sdk-go S3 client's multipart calls take them as.
+func sseSDKParams(h http.Header) (serverSideEncryption, kmsKeyID *string) {
+	if sse := h.Get("x-amz-server-side-encryption"); sse != "" {
+		serverSideEncryption = aws.String(sse)
+	}
+	if kms := h.Get("x-amz-server-side-encryption-aws-kms-key-id"); kms != "" {
+		kmsKeyID = aws.String(kms)
+	}
+	return serverSideEncryption, kmsKeyID
+}
+
+// uploadS3Multipart uploads f (of the given size) to bucket/key as an S3
+// multipart upload, with parts uploaded in parallel by a pool of
+// concurrency workers. If any part fails, the in-progress upload is
+// aborted so S3 doesn't keep billing for the parts that did succeed.
+func uploadS3Multipart(
+	ctx context.Context,
+	svc *s3.S3,
+	bucket, key string,
+	f *os.File,
+	size, partSize int64,
+	concurrency int,
+	sseHeaders http.Header,
+) error {
+	sse, kmsKeyID := sseSDKParams(sseHeaders)
+	created, err := svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "initiating S3 multipart upload")
+	}
+	uploadID := created.UploadId
+
+	numParts := int((size + partSize - 1) / partSize)
+	parts := make([]*s3.CompletedPart, numParts)
+	err = uploadPartsConcurrently(ctx, size, partSize, concurrency,
+		func(ctx context.Context, partIndex int, offset, length int64) error {
+			partNumber := aws.Int64(int64(partIndex) + 1)
+			out, err := svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(bucket),
+				Key:        aws.String(key),
+				UploadId:   uploadID,
+				PartNumber: partNumber,
+				Body:       io.NewSectionReader(f, offset, length),
+			})
+			if err != nil {
+				return errors.Wrapf(err, "uploading part %d", partIndex)
+			}
+			parts[partIndex] = &s3.CompletedPart{ETag: out.ETag, PartNumber: partNumber}
+			return nil
+		})
+	if err != nil {
+		_, abortErr := svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket: aws.String(bucket), Key: aws.String(key), UploadId: uploadID,
+		})
+		if abortErr != nil {
+			return errors.Wrapf(err, "aborting multipart upload also failed: %s", abortErr)
+		}
+		return err
+	}
+
+	_, err = svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		_, abortErr := svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket: aws.String(bucket), Key: aws.String(key), UploadId: uploadID,
+		})
+		if abortErr != nil {
+			return errors.Wrapf(err, "aborting multipart upload also failed: %s", abortErr)
+		}
+		return errors.Wrap(err, "completing S3 multipart upload")
+	}
+	return nil
+}
+
+func (w *s3FileWriter) Cleanup() {
+	w.cleanup()
+}
+
+type s3Storage struct {
+	bucket *s3gof3r.Bucket
+	// s3svc is used for operations gof3r doesn't expose, such as ranged
+	// reads.
+	s3svc      *s3.S3
+	prefix     string
+	conf       *roachpb.ExportStorage_S3
+	encryption *roachpb.ExportStorageEncryption
+}
+
+func makeS3Storage(
+	ctx context.Context, conf *roachpb.ExportStorage_S3, encryption *roachpb.ExportStorageEncryption,
+) (ExportStorage, error) {
+	if conf == nil {
+		return nil, errors.New("s3 upload requested but no s3 config provided")
+	}
+	domain := ""
+	if conf.Endpoint != "" {
+		domain = conf.Endpoint
+	}
+	keys := s3gof3r.Keys{AccessKey: conf.AccessKey, SecretKey: conf.Secret}
+	bucket := s3gof3r.New(domain, keys).Bucket(conf.Bucket)
+	awsConfig := &aws.Config{
+		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
+	}
+	if conf.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.S3ForcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating AWS session")
+	}
+	return &s3Storage{
+		bucket:     bucket,
+		s3svc:      s3.New(sess),
+		prefix:     conf.Prefix,
+		conf:       conf,
+		encryption: encryption,
+	}, nil
+}
+
+func (s *s3Storage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{
+		Provider:   roachpb.ExportStorageProvider_S3,
+		S3Config:   s.conf,
+		Encryption: s.encryption,
+	}
+}
+
+func (s *s3Storage) key(basename string) string {
+	return filepath.Join(s.prefix, basename)
+}
+
+// sseHeaders returns the SSE-S3/SSE-KMS headers, if any, that should be set
+// on every PUT so S3 encrypts the object at rest. Client-side encryption is
+// handled separately, by clientEncryptedStorage, so it's not considered
+// here.
+func sseHeaders(enc *roachpb.ExportStorageEncryption) http.Header {
+	h := make(http.Header)
+	if enc == nil {
+		return h
+	}
+	switch enc.Mode {
+	case roachpb.ExportStorageEncryption_SSE_S3:
+		h.Set("x-amz-server-side-encryption", "AES256")
+	case roachpb.ExportStorageEncryption_SSE_KMS:
+		h.Set("x-amz-server-side-encryption", "aws:kms")
+		if enc.KMSKeyID != "" {
+			h.Set("x-amz-server-side-encryption-aws-kms-key-id", enc.KMSKeyID)
+		}
+	}
+	return h
+}
+
+func (s *s3Storage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp, err := ioutil.TempFile("", "export-storage-s3")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	partSize, concurrency := multipartSettings(s.conf.PartSizeBytes, s.conf.Concurrency)
+	return &s3FileWriter{
+		ctx:         ctx,
+		tmp:         tmp.Name(),
+		bucket:      s.conf.Bucket,
+		key:         s.key(basename),
+		s3:          s.bucket,
+		svc:         s.s3svc,
+		sseHeaders:  sseHeaders(s.encryption),
+		partSize:    partSize,
+		concurrency: concurrency,
+		cleanup:     func() { _ = os.Remove(tmp.Name()) },
+	}, nil
+}
+
+// s3MultipartWriter buffers writes into partSize-sized chunks and uploads
+// each as an S3 multipart part via UploadPartWithContext, committing the
+// accumulated part list with CompleteMultipartUploadWithContext on Close. If
+// ctx is canceled, at any point up to and including Close, the in-progress
+// multipart upload is aborted instead of being finalized with whatever parts
+// had already been sent.
+type s3MultipartWriter struct {
+	ctx         context.Context
+	svc         *s3.S3
+	bucket, key string
+	uploadID    *string
+	buf         bytes.Buffer
+	partSize    int
+	partNum     int64
+	parts       []*s3.CompletedPart
+}
+
+func (w *s3MultipartWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, _ := w.buf.Write(b)
+	for w.buf.Len() >= w.partSize {
+		if err := w.uploadPart(w.buf.Next(w.partSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3MultipartWriter) uploadPart(chunk []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.partNum++
+	partNumber := aws.Int64(w.partNum)
+	out, err := w.svc.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(w.bucket),
+		Key:        aws.String(w.key),
+		UploadId:   w.uploadID,
+		PartNumber: partNumber,
+		Body:       bytes.NewReader(chunk),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "uploading part %d", w.partNum)
+	}
+	w.parts = append(w.parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: partNumber})
+	return nil
+}
+
+func (w *s3MultipartWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		w.abort()
+		return err
+	}
+	if w.buf.Len() > 0 || len(w.parts) == 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if _, err := w.svc.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        w.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: w.parts},
+	}); err != nil {
+		w.abort()
+		return errors.Wrap(err, "completing S3 multipart upload")
+	}
+	return nil
+}
+
+// abort is called with the caller's ctx already canceled or erroring, so it
+// uses a fresh context rather than one that would make the abort call itself
+// fail immediately.
+func (w *s3MultipartWriter) abort() {
+	_, _ = w.svc.AbortMultipartUploadWithContext(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: w.uploadID,
+	})
+}
+
+// Writer streams basename's content as a sequence of multipart parts,
+// committing them with a single CompleteMultipartUpload on Close, so the
+// whole object never needs to be buffered locally or known in size up front.
+func (s *s3Storage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	sse, kmsKeyID := sseSDKParams(sseHeaders(s.encryption))
+	key := s.key(basename)
+	created, err := s.s3svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.conf.Bucket),
+		Key:                  aws.String(key),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "initiating S3 multipart upload")
+	}
+	partSize, _ := multipartSettings(s.conf.PartSizeBytes, s.conf.Concurrency)
+	return &s3MultipartWriter{
+		ctx:      ctx,
+		svc:      s.s3svc,
+		bucket:   s.conf.Bucket,
+		key:      key,
+		uploadID: created.UploadId,
+		partSize: int(partSize),
+	}, nil
+}
+
+func (s *s3Storage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, _, err := s.bucket.GetReader(s.key(basename), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching from S3")
+	}
+	return r, nil
+}
+
+func (s *s3Storage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	key := s.key(basename)
+	open := func(ctx context.Context, pos int64) (io.ReadCloser, error) {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - (pos - offset)
+		}
+		out, err := s.s3svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.conf.Bucket),
+			Key:    aws.String(key),
+			Range:  aws.String(rangeHeader(pos, remaining)),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching range from S3")
+		}
+		return out.Body, nil
+	}
+	return &resumingReader{ctx: ctx, open: open, pos: offset}, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, basename string) error {
+	return s.bucket.Delete(s.key(basename))
+}
+
+// s3ListPageSize overrides the number of keys ListObjectsV2 requests per
+// page when nonzero. Tests shrink it to force List to exercise its
+// multi-page path without needing thousands of objects.
+var s3ListPageSize int64
+
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.conf.Bucket),
+		Prefix: aws.String(s.key(prefix)),
+	}
+	if s3ListPageSize > 0 {
+		input.MaxKeys = aws.Int64(s3ListPageSize)
+	}
+	var names []string
+	err := s.s3svc.ListObjectsV2PagesWithContext(ctx, input,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if rel, err := filepath.Rel(s.prefix, aws.StringValue(obj.Key)); err == nil {
+					names = append(names, rel)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing S3 objects")
+	}
+	return names, nil
+}
+
+// s3DeleteBatchSize is the maximum number of keys S3's DeleteObjects allows
+// in a single call.
+const s3DeleteBatchSize = 1000
+
+func (s *s3Storage) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(names); i += s3DeleteBatchSize {
+		end := i + s3DeleteBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		objs := make([]*s3.ObjectIdentifier, len(names[i:end]))
+		for j, name := range names[i:end] {
+			objs[j] = &s3.ObjectIdentifier{Key: aws.String(s.key(name))}
+		}
+		if _, err := s.s3svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.conf.Bucket),
+			Delete: &s3.Delete{Objects: objs},
+		}); err != nil {
+			return errors.Wrap(err, "bulk deleting S3 objects")
+		}
+	}
+	return nil
+}
+
+func (*s3Storage) Close() error {
+	return nil
+}
+
+// gcsFileWriter stages a file locally, copying it into a GCS object writer
+// on Finish. Files larger than a single part, when the concurrency is above
+// one, are uploaded as separate part objects in parallel and then combined
+// with Compose; other files are streamed through a single object writer.
+type gcsFileWriter struct {
+	ctx         context.Context
+	tmp         string
+	bucket      *storage.BucketHandle
+	key         string
+	kmsKeyName  string
+	partSize    int64
+	concurrency int
+	cleanup     func()
+}
+
+func (w *gcsFileWriter) LocalFile() string { return w.tmp }
+
+func (w *gcsFileWriter) Finish() error {
+	f, err := os.Open(w.tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= w.partSize || w.concurrency <= 1 {
+		wc := w.bucket.Object(w.key).NewWriter(w.ctx)
+		wc.KMSKeyName = w.kmsKeyName
+		if _, err := io.Copy(wc, f); err != nil {
+			wc.Close()
+			return errors.Wrap(err, "uploading to GCS")
+		}
+		return wc.Close()
+	}
+	return uploadGCSMultipart(w.ctx, w.bucket, w.key, w.kmsKeyName, f, info.Size(), w.partSize, w.concurrency)
+}
+
+func (w *gcsFileWriter) Cleanup() {
+	w.cleanup()
+}
+
+// gcsComposeBatchSize is the maximum number of source objects GCS's Compose
+// allows in a single call.
+const gcsComposeBatchSize = 32
+
+// deleteGCSParts best-effort deletes the named objects, ignoring errors
+// (e.g. a part that was never successfully written), since it's only ever
+// called to clean up intermediate state that's no longer needed.
+func deleteGCSParts(ctx context.Context, bucket *storage.BucketHandle, names []string) {
+	for _, n := range names {
+		_ = bucket.Object(n).Delete(ctx)
+	}
+}
+
+// uploadGCSMultipart uploads f (of the given size) to bucket/key by writing
+// each part as its own temporary object in parallel, then combining them
+// with Compose, recursively batching by gcsComposeBatchSize since Compose
+// itself accepts only up to that many sources per call. The part and any
+// intermediate composed objects are deleted once no longer needed, whether
+// or not the upload ultimately succeeds.
+func uploadGCSMultipart(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	key, kmsKeyName string,
+	f *os.File,
+	size, partSize int64,
+	concurrency int,
+) error {
+	numParts := int((size + partSize - 1) / partSize)
+	partNames := make([]string, numParts)
+	err := uploadPartsConcurrently(ctx, size, partSize, concurrency,
+		func(ctx context.Context, partIndex int, offset, length int64) error {
+			partName := fmt.Sprintf("%s.part-%06d", key, partIndex)
+			partNames[partIndex] = partName
+			wc := bucket.Object(partName).NewWriter(ctx)
+			wc.KMSKeyName = kmsKeyName
+			if _, err := io.Copy(wc, io.NewSectionReader(f, offset, length)); err != nil {
+				wc.Close()
+				return errors.Wrapf(err, "uploading part %d", partIndex)
+			}
+			return wc.Close()
+		})
+	if err != nil {
+		deleteGCSParts(ctx, bucket, partNames)
+		return err
+	}
+
+	var intermediates []string
+	names := partNames
+	for len(names) > gcsComposeBatchSize {
+		var next []string
+		for i := 0; i < len(names); i += gcsComposeBatchSize {
+			end := i + gcsComposeBatchSize
+			if end > len(names) {
+				end = len(names)
+			}
+			group := names[i:end]
+			composedName := fmt.Sprintf("%s.compose-%d", key, len(intermediates))
+			srcs := make([]*storage.ObjectHandle, len(group))
+			for j, n := range group {
+				srcs[j] = bucket.Object(n)
+			}
+			composer := bucket.Object(composedName).ComposerFrom(srcs...)
+			composer.KMSKeyName = kmsKeyName
+			if _, err := composer.Run(ctx); err != nil {
+				deleteGCSParts(ctx, bucket, partNames)
+				deleteGCSParts(ctx, bucket, intermediates)
+				return errors.Wrap(err, "composing GCS parts")
+			}
+			intermediates = append(intermediates, composedName)
+			next = append(next, composedName)
+		}
+		names = next
+	}
+
+	srcs := make([]*storage.ObjectHandle, len(names))
+	for i, n := range names {
+		srcs[i] = bucket.Object(n)
+	}
+	composer := bucket.Object(key).ComposerFrom(srcs...)
+	composer.KMSKeyName = kmsKeyName
+	_, err = composer.Run(ctx)
+	deleteGCSParts(ctx, bucket, partNames)
+	deleteGCSParts(ctx, bucket, intermediates)
+	if err != nil {
+		return errors.Wrap(err, "composing GCS parts into final object")
+	}
+	return nil
+}
+
+type gcsStorage struct {
+	bucket     *storage.BucketHandle
+	prefix     string
+	conf       *roachpb.ExportStorage_GCS
+	encryption *roachpb.ExportStorageEncryption
+}
+
+func makeGCSStorage(
+	ctx context.Context, conf *roachpb.ExportStorage_GCS, encryption *roachpb.ExportStorageEncryption,
+) (ExportStorage, error) {
+	if conf == nil {
+		return nil, errors.New("google cloud storage upload requested but no config provided")
+	}
+	opts := []option.ClientOption{option.WithScopes(storage.ScopeReadWrite)}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating GCS client")
+	}
+	return &gcsStorage{
+		bucket:     client.Bucket(conf.Bucket),
+		prefix:     conf.Prefix,
+		conf:       conf,
+		encryption: encryption,
+	}, nil
+}
+
+func (g *gcsStorage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{
+		Provider:          roachpb.ExportStorageProvider_GoogleCloud,
+		GoogleCloudConfig: g.conf,
+		Encryption:        g.encryption,
+	}
+}
+
+func (g *gcsStorage) key(basename string) string {
+	return filepath.Join(g.prefix, basename)
+}
+
+// kmsKeyName returns the CMEK key GCS should encrypt with, or "" to use
+// GCS's default (always-on) encryption. Only the SSE_KMS mode has a GCS
+// equivalent; client-side encryption is handled separately.
+func (g *gcsStorage) kmsKeyName() string {
+	if g.encryption != nil && g.encryption.Mode == roachpb.ExportStorageEncryption_SSE_KMS {
+		return g.encryption.KMSKeyID
+	}
+	return ""
+}
+
+func (g *gcsStorage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp, err := ioutil.TempFile("", "export-storage-gcs")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	partSize, concurrency := multipartSettings(g.conf.PartSizeBytes, g.conf.Concurrency)
+	return &gcsFileWriter{
+		ctx:         ctx,
+		tmp:         tmp.Name(),
+		bucket:      g.bucket,
+		key:         g.key(basename),
+		kmsKeyName:  g.kmsKeyName(),
+		partSize:    partSize,
+		concurrency: concurrency,
+		cleanup:     func() { _ = os.Remove(tmp.Name()) },
+	}, nil
+}
+
+// Writer returns a GCS resumable upload writer, which streams writes to GCS
+// as they arrive rather than requiring the whole object up front; canceling
+// ctx aborts the underlying resumable session.
+func (g *gcsStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	w := g.bucket.Object(g.key(basename)).NewWriter(ctx)
+	w.KMSKeyName = g.kmsKeyName()
+	return w, nil
+}
+
+func (g *gcsStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	r, err := g.bucket.Object(g.key(basename)).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching from GCS")
+	}
+	return r, nil
+}
+
+func (g *gcsStorage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	key := g.key(basename)
+	open := func(ctx context.Context, pos int64) (io.ReadCloser, error) {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - (pos - offset)
+		}
+		r, err := g.bucket.Object(key).NewRangeReader(ctx, pos, remaining)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching range from GCS")
+		}
+		return r, nil
+	}
+	return &resumingReader{ctx: ctx, open: open, pos: offset}, nil
+}
+
+func (g *gcsStorage) Delete(ctx context.Context, basename string) error {
+	return g.bucket.Object(g.key(basename)).Delete(ctx)
+}
+
+// gcsListPageSize overrides the number of objects the GCS object iterator
+// requests per page when nonzero. Tests shrink it to force List to exercise
+// its multi-page path without needing thousands of objects.
+var gcsListPageSize int
+
+func (g *gcsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	it := g.bucket.Objects(ctx, &storage.Query{Prefix: g.key(prefix)})
+	if gcsListPageSize > 0 {
+		it.PageInfo().MaxSize = gcsListPageSize
+	}
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "listing GCS objects")
+		}
+		if rel, err := filepath.Rel(g.prefix, obj.Name); err == nil {
+			names = append(names, rel)
+		}
+	}
+	return names, nil
+}
+
+func (g *gcsStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := g.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := g.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*gcsStorage) Close() error {
+	return nil
+}
+
+// azureFileWriter stages a file locally, uploading it on Finish. Files
+// larger than a single part, when the concurrency is above one, are staged
+// as blocks in parallel and committed with a single PutBlockList; other
+// files are uploaded as a single block blob.
+type azureFileWriter struct {
+	ctx         context.Context
+	tmp, key    string
+	client      azureblob.BlobStorageClient
+	container   string
+	cpkHeaders  map[string]string
+	partSize    int64
+	concurrency int
+	cleanup     func()
+}
+
+func (w *azureFileWriter) LocalFile() string { return w.tmp }
+
+func (w *azureFileWriter) Finish() error {
+	f, err := os.Open(w.tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= w.partSize || w.concurrency <= 1 {
+		return w.client.CreateBlockBlobFromReader(w.container, w.key, uint64(info.Size()), f, w.cpkHeaders)
+	}
+	return uploadAzureMultipart(w.ctx, w.client, w.container, w.key, f, info.Size(), w.partSize, w.concurrency, w.cpkHeaders)
+}
+
+func (w *azureFileWriter) Cleanup() {
+	w.cleanup()
+}
+
+// uploadAzureMultipart uploads f (of the given size) to container/key by
+// staging each part as its own block in parallel, then committing the
+// accumulated block list with a single PutBlockList call. There's no API to
+// delete an individual staged block on failure, but an uncommitted block
+// that's never referenced by a PutBlockList is automatically garbage
+// collected by Azure Storage about a week after it was staged, so a failed
+// upload doesn't leak storage indefinitely.
+func uploadAzureMultipart(
+	ctx context.Context,
+	client azureblob.BlobStorageClient,
+	container, key string,
+	f *os.File,
+	size, partSize int64,
+	concurrency int,
+	cpkHeaders map[string]string,
+) error {
+	numParts := int((size + partSize - 1) / partSize)
+	blockIDs := make([]string, numParts)
+	err := uploadPartsConcurrently(ctx, size, partSize, concurrency,
+		func(ctx context.Context, partIndex int, offset, length int64) error {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%010d", partIndex)))
+			blockIDs[partIndex] = id
+			buf := make([]byte, length)
+			if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+				return errors.Wrapf(err, "reading part %d", partIndex)
+			}
+			if err := client.PutBlock(container, key, id, buf, cpkHeaders); err != nil {
+				return errors.Wrapf(err, "staging part %d", partIndex)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	return client.PutBlockList(container, key, blockIDs, cpkHeaders)
+}
+
+type azureStorage struct {
+	client     azureblob.BlobStorageClient
+	container  string
+	prefix     string
+	conf       *roachpb.ExportStorage_Azure
+	encryption *roachpb.ExportStorageEncryption
+}
+
+func makeAzureStorage(
+	conf *roachpb.ExportStorage_Azure, encryption *roachpb.ExportStorageEncryption,
+) (ExportStorage, error) {
+	if conf == nil {
+		return nil, errors.New("azure upload requested but no azure config provided")
+	}
+	client, err := azureblob.NewBasicClient(conf.AccountName, conf.AccountKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating Azure client")
+	}
+	return &azureStorage{
+		client:     client.GetBlobService(),
+		container:  conf.Container,
+		prefix:     conf.Prefix,
+		conf:       conf,
+		encryption: encryption,
+	}, nil
+}
+
+func (a *azureStorage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{
+		Provider:    roachpb.ExportStorageProvider_Azure,
+		AzureConfig: a.conf,
+		Encryption:  a.encryption,
+	}
+}
+
+func (a *azureStorage) key(basename string) string {
+	return filepath.Join(a.prefix, basename)
+}
+
+// azureCPKHeaders returns the customer-provided-key headers, if any, that
+// should accompany every put/get so Azure Storage encrypts/decrypts with
+// the caller's own key. Azure Storage Service Encryption is always on for
+// data at rest, but (unlike S3/GCS) offers no per-request SSE-S3/SSE-KMS
+// style toggle, so CPK (requested as SSE_KMS with a raw Key, since Azure has
+// no KMS-key-ID concept to mirror S3/GCS's SSE_KMS) is the only server-side
+// option this provider supports beyond that default.
+func azureCPKHeaders(enc *roachpb.ExportStorageEncryption) map[string]string {
+	if enc == nil || enc.Mode != roachpb.ExportStorageEncryption_SSE_KMS || len(enc.Key) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(enc.Key)
+	return map[string]string{
+		"x-ms-encryption-key":        base64.StdEncoding.EncodeToString(enc.Key),
+		"x-ms-encryption-key-sha256": base64.StdEncoding.EncodeToString(sum[:]),
+		"x-ms-encryption-algorithm":  "AES256",
+	}
+}
+
+func (a *azureStorage) PutFile(ctx context.Context, basename string) (ExportStorageWriter, error) {
+	tmp, err := ioutil.TempFile("", "export-storage-azure")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	partSize, concurrency := multipartSettings(a.conf.PartSizeBytes, a.conf.Concurrency)
+	return &azureFileWriter{
+		ctx:         ctx,
+		tmp:         tmp.Name(),
+		key:         a.key(basename),
+		client:      a.client,
+		container:   a.container,
+		cpkHeaders:  azureCPKHeaders(a.encryption),
+		partSize:    partSize,
+		concurrency: concurrency,
+		cleanup:     func() { _ = os.Remove(tmp.Name()) },
+	}, nil
+}
+
+// azureBlockBlobWriter buffers writes into fixed-size chunks and stages each
+// as a block via PutBlock, committing the accumulated block list on Close.
+// This lets basename be written without knowing its final size up front,
+// unlike CreateBlockBlobFromReader.
+type azureBlockBlobWriter struct {
+	ctx            context.Context
+	client         azureblob.BlobStorageClient
+	container, key string
+	cpkHeaders     map[string]string
+	buf            bytes.Buffer
+	blockSize      int
+	blockIDs       []string
+}
+
+const azureBlockSize = 4 * 1024 * 1024 // 4MiB, the default block size.
+
+func (w *azureBlockBlobWriter) Write(b []byte) (int, error) {
+	n, err := w.buf.Write(b)
+	if err != nil {
+		return n, err
+	}
+	for w.buf.Len() >= w.blockSize {
+		if err := w.flushBlock(w.buf.Next(w.blockSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *azureBlockBlobWriter) flushBlock(chunk []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%010d", len(w.blockIDs))))
+	if err := w.client.PutBlock(w.container, w.key, id, chunk, w.cpkHeaders); err != nil {
+		return errors.Wrap(err, "staging Azure block")
+	}
+	w.blockIDs = append(w.blockIDs, id)
+	return nil
+}
+
+// Close commits the staged blocks with a single PutBlockList call, unless ctx
+// has been canceled, in which case it skips the commit and leaves whatever
+// blocks were staged uncommitted: Azure Storage garbage collects any block
+// that's never referenced by a PutBlockList, so a canceled upload doesn't
+// leave a truncated blob visible under basename.
+func (w *azureBlockBlobWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.flushBlock(w.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return w.client.PutBlockList(w.container, w.key, w.blockIDs, w.cpkHeaders)
+}
+
+// Writer stages basename's content as a sequence of blocks, committing them
+// with a single PutBlockList on Close, so the whole blob never needs to be
+// buffered locally or known in size up front.
+func (a *azureStorage) Writer(ctx context.Context, basename string) (io.WriteCloser, error) {
+	return &azureBlockBlobWriter{
+		ctx:        ctx,
+		client:     a.client,
+		container:  a.container,
+		key:        a.key(basename),
+		cpkHeaders: azureCPKHeaders(a.encryption),
+		blockSize:  azureBlockSize,
+	}, nil
+}
+
+func (a *azureStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	if headers := azureCPKHeaders(a.encryption); headers != nil {
+		return a.client.GetBlobRange(a.container, a.key(basename), "", headers)
+	}
+	return a.client.GetBlob(a.container, a.key(basename))
+}
+
+func (a *azureStorage) ReadFileAt(
+	ctx context.Context, basename string, offset, length int64,
+) (io.ReadCloser, error) {
+	key := a.key(basename)
+	open := func(ctx context.Context, pos int64) (io.ReadCloser, error) {
+		remaining := int64(-1)
+		if length >= 0 {
+			remaining = length - (pos - offset)
+		}
+		byteRange := fmt.Sprintf("%d-", pos)
+		if remaining >= 0 {
+			byteRange = fmt.Sprintf("%d-%d", pos, pos+remaining-1)
+		}
+		return a.client.GetBlobRange(a.container, key, byteRange, azureCPKHeaders(a.encryption))
+	}
+	return &resumingReader{ctx: ctx, open: open, pos: offset}, nil
+}
+
+func (a *azureStorage) Delete(ctx context.Context, basename string) error {
+	_, err := a.client.DeleteBlobIfExists(a.container, a.key(basename), nil)
+	return err
+}
+
+// azureListPageSize overrides the number of blobs ListBlobsSegmented
+// requests per page when nonzero. Tests shrink it to force List to
+// exercise its multi-page path without needing thousands of blobs.
+var azureListPageSize uint
+
+func (a *azureStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		resp, err := a.client.ListBlobsSegmented(a.container, azureblob.ListBlobsParameters{
+			Prefix:     a.key(prefix),
+			Marker:     marker,
+			MaxResults: azureListPageSize,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "listing Azure blobs")
+		}
+		for _, b := range resp.Blobs {
+			if rel, err := filepath.Rel(a.prefix, b.Name); err == nil {
+				names = append(names, rel)
+			}
+		}
+		if resp.NextMarker == "" {
+			break
+		}
+		marker = resp.NextMarker
+	}
+	return names, nil
+}
+
+func (a *azureStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	names, err := a.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := a.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*azureStorage) Close() error {
+	return nil
+}
@@ -11,16 +11,30 @@ package storageccl
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"cloud.google.com/go/storage"
+	azureblob "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
 	"github.com/rlmcpherson/s3gof3r"
 	"golang.org/x/net/context"
+	"google.golang.org/api/option"
 
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
@@ -92,6 +106,1217 @@ func testExportToTarget(t *testing.T, args roachpb.ExportStorage) {
 	}
 }
 
+// testExportStorageWriter exercises the streaming Writer path rather than
+// the PutFile/LocalFile/Finish staging path exercised by
+// testExportToTarget.
+func testExportStorageWriter(t *testing.T, args roachpb.ExportStorage) {
+	const size = 1024 * 1024 * 8 // 8MiB
+	testingContent := make([]byte, size)
+	if _, err := rand.Read(testingContent); err != nil {
+		t.Fatal(err)
+	}
+	testingFilename := "testing-123"
+	ctx := context.TODO()
+
+	s, err := MakeExportStorage(ctx, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.Writer(ctx, testingFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(testingContent); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.ReadFile(ctx, testingFilename)
+	if err != nil {
+		t.Fatalf("could not get reader for %s: %+v", testingFilename, err)
+	}
+	defer res.Close()
+	content, err := ioutil.ReadAll(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, testingContent) {
+		t.Fatalf("wrong content")
+	}
+	if err := s.Delete(ctx, testingFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterPutLocal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p, cleanupFn := testutils.TempDir(t, 0)
+	defer cleanupFn()
+
+	testExportStorageWriter(t, roachpb.ExportStorage{
+		Provider:  roachpb.ExportStorageProvider_LocalFile,
+		LocalFile: roachpb.ExportStorage_LocalFilePath{Path: p},
+	})
+}
+
+func TestWriterPutHttp(t *testing.T) {
+	tmp, dirCleanup := testutils.TempDir(t, 0)
+	defer dirCleanup()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		localfile := filepath.Join(tmp, filepath.Base(r.URL.Path))
+		switch r.Method {
+		case "PUT":
+			f, err := os.Create(localfile)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			defer f.Close()
+			if _, err := io.Copy(f, r.Body); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		case "GET":
+			http.ServeFile(w, r, localfile)
+		case "DELETE":
+			if err := os.Remove(localfile); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		default:
+			http.Error(w, "unsupported method "+r.Method, 400)
+		}
+	}))
+	defer srv.Close()
+
+	testExportStorageWriter(t, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: srv.URL + "/"},
+	})
+}
+
+// TestWriterPropagatesUploadError verifies that an error returned by the
+// remote end is surfaced from Writer.Close, rather than being silently
+// swallowed.
+func TestWriterPropagatesUploadError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		io.Copy(ioutil.Discard, r.Body)
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: srv.URL + "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.Writer(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("some content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("expected Close to propagate the upload failure, got nil")
+	}
+}
+
+// TestWriterContextCancelAborts verifies that canceling ctx mid-upload
+// causes the writer to stop accepting writes rather than streaming to
+// completion regardless.
+func TestWriterContextCancelAborts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	blockReq := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		<-blockReq
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer srv.Close()
+	defer close(blockReq)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: srv.URL + "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.Writer(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	// The next write should observe the cancellation rather than blocking
+	// until the (artificially stalled) request completes.
+	if _, err := w.Write([]byte("some content")); err == nil {
+		t.Fatal("expected write after context cancellation to fail")
+	}
+}
+
+// fakeS3MultipartServer serves just enough of the S3 multipart upload API
+// for uploadS3Multipart/s3MultipartWriter to exercise it end-to-end, and
+// counts how many times each operation was invoked. If failPartNumber is
+// nonzero, uploading that part fails, to let tests inject a mid-upload
+// failure.
+type fakeS3MultipartServer struct {
+	*httptest.Server
+	failPartNumber     int
+	completed, aborted int32
+}
+
+func newFakeS3MultipartServer(t *testing.T, failPartNumber int) *fakeS3MultipartServer {
+	f := &fakeS3MultipartServer{failPartNumber: failPartNumber}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		q := r.URL.Query()
+		switch {
+		case r.Method == "POST" && q.Get("uploadId") == "":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key><UploadId>fake-upload-id</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == "PUT" && q.Get("partNumber") != "":
+			io.Copy(ioutil.Discard, r.Body)
+			if fmt.Sprintf("%d", f.failPartNumber) == q.Get("partNumber") {
+				http.Error(w, "injected part upload failure", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("ETag", `"fake-etag"`)
+		case r.Method == "POST" && q.Get("uploadId") != "":
+			atomic.AddInt32(&f.completed, 1)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>key</Key></CompleteMultipartUploadResult>`)
+		case r.Method == "DELETE" && q.Get("uploadId") != "":
+			atomic.AddInt32(&f.aborted, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		}
+	}))
+	return f
+}
+
+// TestWriterContextCancelAbortsS3Multipart verifies that, for the S3
+// provider, canceling ctx after some parts have already been uploaded and
+// then closing the writer (the cleanup sequence a caller would perform)
+// aborts the multipart upload rather than completing it with a truncated
+// set of parts.
+func TestWriterContextCancelAbortsS3Multipart(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	srv := newFakeS3MultipartServer(t, 0)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_S3,
+		S3Config: &roachpb.ExportStorage_S3{
+			Bucket:           "bucket",
+			AccessKey:        "key",
+			Secret:           "secret",
+			Endpoint:         srv.URL,
+			S3ForcePathStyle: true,
+			PartSizeBytes:    1024,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.Writer(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fill and flush two parts before canceling, so the abort path has to
+	// clean up storage the upload had already consumed, not just a freshly
+	// opened upload.
+	if _, err := w.Write(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Fatal("expected Close to fail after ctx was canceled")
+	}
+	if atomic.LoadInt32(&srv.completed) != 0 {
+		t.Fatal("expected the multipart upload not to be completed after ctx was canceled")
+	}
+	if atomic.LoadInt32(&srv.aborted) != 1 {
+		t.Fatalf("expected the multipart upload to be aborted exactly once, got %d", srv.aborted)
+	}
+}
+
+// fakeAzureBlockServer serves just enough of the Azure block blob API for
+// azureBlockBlobWriter to stage blocks, and counts how many times the blob
+// was actually committed with PutBlockList.
+type fakeAzureBlockServer struct {
+	*httptest.Server
+	committed int32
+}
+
+func newFakeAzureBlockServer(t *testing.T) *fakeAzureBlockServer {
+	f := &fakeAzureBlockServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		io.Copy(ioutil.Discard, r.Body)
+		switch r.URL.Query().Get("comp") {
+		case "block":
+			w.WriteHeader(http.StatusCreated)
+		case "blocklist":
+			atomic.AddInt32(&f.committed, 1)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+		}
+	}))
+	return f
+}
+
+// TestWriterContextCancelAbortsAzureBlockBlob verifies that, for the Azure
+// provider, canceling ctx after some blocks have already been staged and
+// then closing the writer (the cleanup sequence a caller would perform)
+// skips committing the block list rather than finalizing a blob made of
+// whatever blocks had already been staged.
+func TestWriterContextCancelAbortsAzureBlockBlob(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	srv := newFakeAzureBlockServer(t)
+	defer srv.Close()
+
+	const fakeAccountKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	client, err := azureblob.NewClient(
+		"account", fakeAccountKey, srv.Listener.Addr().String(), azureblob.DefaultAPIVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	s := &azureStorage{
+		client:    client.GetBlobService(),
+		container: "container",
+	}
+
+	w, err := s.Writer(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, azureBlockSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Fatal("expected Close to fail after ctx was canceled")
+	}
+	if atomic.LoadInt32(&srv.committed) != 0 {
+		t.Fatal("expected the block list not to be committed after ctx was canceled")
+	}
+}
+
+// TestReadFileAtResumesAfterDroppedConnection verifies that ReadFileAt
+// transparently re-issues a ranged request, and so returns an unbroken
+// stream, when the first attempt's connection is dropped mid-body.
+func TestReadFileAtResumesAfterDroppedConnection(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	content := make([]byte, 1<<20) // 1MiB
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+
+	var failedOnce int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		remaining := content[start:]
+
+		if atomic.CompareAndSwapInt32(&failedOnce, 0, 1) {
+			// Simulate a connection dropped mid-transfer: promise the full
+			// remaining length, deliver half of it, then hijack the
+			// connection and close it without finishing the response body,
+			// which surfaces as io.ErrUnexpectedEOF to the client.
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(remaining)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(remaining[:len(remaining)/2])
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				t.Fatal("test server response writer does not support hijacking")
+			}
+			conn, _, err := hj.Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(remaining)
+	}))
+	defer srv.Close()
+
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: srv.URL + "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r, err := s.ReadFileAt(ctx, "testing-123", 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("resumed read did not reproduce original content (got %d bytes, want %d)", len(got), len(content))
+	}
+}
+
+func TestPutLocalClientSideEncrypted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p, cleanupFn := testutils.TempDir(t, 0)
+	defer cleanupFn()
+
+	testExportToTarget(t, roachpb.ExportStorage{
+		Provider:  roachpb.ExportStorageProvider_LocalFile,
+		LocalFile: roachpb.ExportStorage_LocalFilePath{Path: p},
+		Encryption: &roachpb.ExportStorageEncryption{
+			Mode:       roachpb.ExportStorageEncryption_ClientAESGCM,
+			Passphrase: "correct horse battery staple",
+		},
+	})
+}
+
+// TestClientSideEncryptionWrongKeyFails verifies that a file written with
+// client-side encryption cannot be read back using the wrong passphrase.
+func TestClientSideEncryptionWrongKeyFails(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p, cleanupFn := testutils.TempDir(t, 0)
+	defer cleanupFn()
+	ctx := context.TODO()
+
+	writeArgs := roachpb.ExportStorage{
+		Provider:  roachpb.ExportStorageProvider_LocalFile,
+		LocalFile: roachpb.ExportStorage_LocalFilePath{Path: p},
+		Encryption: &roachpb.ExportStorageEncryption{
+			Mode:       roachpb.ExportStorageEncryption_ClientAESGCM,
+			Passphrase: "correct horse battery staple",
+		},
+	}
+	s, err := MakeExportStorage(ctx, writeArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.Writer(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("some secret content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongArgs := writeArgs
+	wrongArgs.Encryption = &roachpb.ExportStorageEncryption{
+		Mode:       roachpb.ExportStorageEncryption_ClientAESGCM,
+		Passphrase: "wrong passphrase",
+	}
+	wrongKeyStorage, err := MakeExportStorage(ctx, wrongArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrongKeyStorage.Close()
+
+	if _, err := wrongKeyStorage.ReadFile(ctx, "testing-123"); err == nil {
+		t.Fatal("expected reading with the wrong key to fail")
+	}
+}
+
+// TestEncryptionModeProviderMismatchRejected verifies that MakeExportStorage
+// rejects a server-side encryption mode the destination's provider has no
+// way to honor, rather than silently falling back to no encryption.
+func TestEncryptionModeProviderMismatchRejected(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		name     string
+		provider roachpb.ExportStorageProvider
+		enc      *roachpb.ExportStorageEncryption
+		wantErr  bool
+	}{
+		{
+			name:     "SSE_S3 against GoogleCloud is rejected",
+			provider: roachpb.ExportStorageProvider_GoogleCloud,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_S3},
+			wantErr:  true,
+		},
+		{
+			name:     "SSE_S3 against Azure is rejected",
+			provider: roachpb.ExportStorageProvider_Azure,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_S3},
+			wantErr:  true,
+		},
+		{
+			name:     "SSE_KMS against Azure without a Key is rejected",
+			provider: roachpb.ExportStorageProvider_Azure,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_KMS},
+			wantErr:  true,
+		},
+		{
+			name:     "SSE_KMS against Azure with a Key is accepted",
+			provider: roachpb.ExportStorageProvider_Azure,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_KMS, Key: []byte("0123456789abcdef0123456789abcdef")},
+			wantErr:  false,
+		},
+		{
+			name:     "SSE_KMS against GoogleCloud without a KMSKeyID is rejected",
+			provider: roachpb.ExportStorageProvider_GoogleCloud,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_KMS},
+			wantErr:  true,
+		},
+		{
+			name:     "SSE_S3 against S3 is accepted",
+			provider: roachpb.ExportStorageProvider_S3,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_SSE_S3},
+			wantErr:  false,
+		},
+		{
+			name:     "ClientAESGCM is accepted against Azure",
+			provider: roachpb.ExportStorageProvider_Azure,
+			enc:      &roachpb.ExportStorageEncryption{Mode: roachpb.ExportStorageEncryption_ClientAESGCM, Passphrase: "x"},
+			wantErr:  false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateEncryptionMode(tc.provider, tc.enc)
+			if tc.wantErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected no error, got %+v", err)
+			}
+		})
+	}
+}
+
+// TestRegisterProviderDuplicatePanics verifies that registering two
+// openers for the same scheme, which would otherwise silently shadow one of
+// them, is instead caught early.
+func TestRegisterProviderDuplicatePanics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected RegisterProvider to panic on a duplicate scheme")
+		}
+	}()
+	RegisterProvider("nodelocal", openLocalFileStorage)
+}
+
+// TestExportStorageFromURICustomProvider verifies that ExportStorageFromURI
+// dispatches to an out-of-tree provider registered via RegisterProvider,
+// passing it the parsed URI, rather than being limited to the providers
+// built into the roachpb.ExportStorageProvider enum.
+func TestExportStorageFromURICustomProvider(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const scheme = "fake-custom-provider"
+	var gotHost, gotQuery string
+	RegisterProvider(scheme, func(ctx context.Context, uri *url.URL) (ExportStorage, error) {
+		gotHost = uri.Host
+		gotQuery = uri.Query().Get("foo")
+		return &localFileStorage{base: os.TempDir()}, nil
+	})
+
+	s, err := ExportStorageFromURI(context.TODO(), scheme+"://some-bucket?foo=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if gotHost != "some-bucket" {
+		t.Fatalf("got host %q, expected %q", gotHost, "some-bucket")
+	}
+	if gotQuery != "bar" {
+		t.Fatalf("got query param %q, expected %q", gotQuery, "bar")
+	}
+}
+
+// TestS3ConfigParsesCustomEndpoint verifies that an s3:// URI pointing at an
+// S3-compatible service (e.g. MinIO or Ceph/RGW) via the AWS_ENDPOINT and
+// AWS_S3_FORCE_PATH_STYLE query parameters round-trips into the resulting
+// roachpb.ExportStorage_S3, since it's this config that later drives
+// makeS3Storage to talk to that endpoint instead of AWS's own.
+func TestS3ConfigParsesCustomEndpoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	conf, err := ExportStorageConfFromURI(
+		"s3://bucket/prefix?AWS_ACCESS_KEY_ID=key&AWS_SECRET_ACCESS_KEY=secret" +
+			"&AWS_ENDPOINT=http://minio.local:9000&AWS_S3_FORCE_PATH_STYLE=true",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.S3Config.Endpoint != "http://minio.local:9000" {
+		t.Fatalf("got endpoint %q, expected %q", conf.S3Config.Endpoint, "http://minio.local:9000")
+	}
+	if !conf.S3Config.S3ForcePathStyle {
+		t.Fatal("expected S3ForcePathStyle to be true")
+	}
+}
+
+// TestUploadPartsConcurrentlyWaitsForInFlightPartsOnFailure verifies that
+// when one part of a parallel multipart upload fails, uploadPartsConcurrently
+// still waits for every other part's callback to run to completion (per its
+// documented contract) before returning the error, so a caller can reliably
+// see, and clean up, every part that actually got uploaded.
+func TestUploadPartsConcurrentlyWaitsForInFlightPartsOnFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numParts = 6
+	const failPart = 3
+	const partSize = 1024
+
+	var mu sync.Mutex
+	uploaded := make(map[int]bool)
+
+	err := uploadPartsConcurrently(context.TODO(), numParts*partSize, partSize, 2,
+		func(ctx context.Context, partIndex int, offset, length int64) error {
+			if partIndex == failPart {
+				return errors.New("injected upload failure")
+			}
+			mu.Lock()
+			uploaded[partIndex] = true
+			mu.Unlock()
+			return nil
+		})
+	if err == nil {
+		t.Fatal("expected uploadPartsConcurrently to return the injected failure")
+	}
+
+	if uploaded[failPart] {
+		t.Fatalf("the failed part %d should never be marked uploaded", failPart)
+	}
+	if len(uploaded) != numParts-1 {
+		t.Fatalf("expected every part other than the failed one to have been "+
+			"uploaded before uploadPartsConcurrently returned, got %d of %d", len(uploaded), numParts-1)
+	}
+	for i := 0; i < numParts; i++ {
+		if i != failPart && !uploaded[i] {
+			t.Fatalf("part %d was never uploaded", i)
+		}
+	}
+}
+
+// TestPutFileS3MultipartCleansUpOnFailure verifies that uploadS3Multipart,
+// exercised end-to-end against a fake S3 backend via the public PutFile
+// path, aborts the multipart upload when one part fails instead of leaving
+// it dangling or completing it with a truncated part list.
+func TestPutFileS3MultipartCleansUpOnFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const failPartNumber = 3 // 1-indexed, as S3 part numbers are.
+	srv := newFakeS3MultipartServer(t, failPartNumber)
+	defer srv.Close()
+
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_S3,
+		S3Config: &roachpb.ExportStorage_S3{
+			Bucket:           "bucket",
+			AccessKey:        "key",
+			Secret:           "secret",
+			Endpoint:         srv.URL,
+			S3ForcePathStyle: true,
+			PartSizeBytes:    1024,
+			Concurrency:      2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w, err := s.PutFile(ctx, "testing-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Cleanup()
+	if err := ioutil.WriteFile(w.LocalFile(), make([]byte, 6*1024), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err == nil {
+		t.Fatal("expected Finish to return the injected part failure")
+	}
+	if atomic.LoadInt32(&srv.completed) != 0 {
+		t.Fatal("expected the multipart upload not to be completed after a part failed")
+	}
+	if atomic.LoadInt32(&srv.aborted) != 1 {
+		t.Fatalf("expected the multipart upload to be aborted exactly once, got %d", srv.aborted)
+	}
+}
+
+// fakeGCSServer serves just enough of the GCS JSON/resumable-upload API for
+// uploadGCSMultipart to exercise it end-to-end, and records which objects
+// were deleted. Initiating an upload for an object named failName fails, to
+// let tests inject a mid-upload failure.
+type fakeGCSServer struct {
+	*httptest.Server
+	failName string
+	mu       sync.Mutex
+	deleted  []string
+}
+
+func newFakeGCSServer(t *testing.T, failName string) *fakeGCSServer {
+	f := &fakeGCSServer{failName: failName}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		switch {
+		case r.Method == "POST" && strings.Contains(r.URL.Path, "/o") && r.URL.Query().Get("uploadType") == "resumable":
+			name := r.URL.Query().Get("name")
+			if name == f.failName {
+				http.Error(w, "injected part upload failure", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", f.URL+"/upload/session?name="+url.QueryEscape(name))
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/upload/session"):
+			io.Copy(ioutil.Discard, r.Body)
+			fmt.Fprintf(w, `{"name": %q, "bucket": "bucket"}`, r.URL.Query().Get("name"))
+		case r.Method == "DELETE":
+			f.mu.Lock()
+			f.deleted = append(f.deleted, path.Base(r.URL.Path))
+			f.mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+		}
+	}))
+	return f
+}
+
+// TestUploadGCSMultipartCleansUpOnFailure verifies that uploadGCSMultipart,
+// exercised against a fake GCS backend, issues deletes to clean up parts
+// after a later part fails, rather than leaking them.
+func TestUploadGCSMultipartCleansUpOnFailure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const numParts = 4
+	const partSize = 1024
+	const key = "backup-file"
+	failName := fmt.Sprintf("%s.part-%06d", key, 2)
+
+	srv := newFakeGCSServer(t, failName)
+	defer srv.Close()
+
+	ctx := context.TODO()
+	client, err := storage.NewClient(ctx,
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithHTTPClient(srv.Client()),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := client.Bucket("bucket")
+
+	tmp, err := ioutil.TempFile("", "gcs-multipart-fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(make([]byte, numParts*partSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = uploadGCSMultipart(ctx, bucket, key, "", tmp, numParts*partSize, partSize, 2)
+	if err == nil {
+		t.Fatal("expected uploadGCSMultipart to return the injected failure")
+	}
+	if len(srv.deleted) == 0 {
+		t.Fatal("expected the parts that did upload to be cleaned up after the failure")
+	}
+}
+
+// TestListAndDeletePrefixLocal verifies that List finds every file sharing
+// a prefix (and only those), and that DeletePrefix removes exactly that
+// set, leaving files outside the prefix untouched.
+func TestListAndDeletePrefixLocal(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	p, cleanupFn := testutils.TempDir(t, 0)
+	defer cleanupFn()
+	ctx := context.TODO()
+
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider:  roachpb.ExportStorageProvider_LocalFile,
+		LocalFile: roachpb.ExportStorage_LocalFilePath{Path: p},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const n = 50
+	const prefix = "backup-part-"
+	want := make([]string, n)
+	for i := range want {
+		name := fmt.Sprintf("%s%03d", prefix, i)
+		want[i] = name
+		w, err := s.Writer(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unrelated := "manifest"
+	w, err := s.Writer(ctx, unrelated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("not part of the backup")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.List(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %v, expected %v", got, want)
+	}
+
+	if err := s.DeletePrefix(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	remaining, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, []string{unrelated}) {
+		t.Fatalf("expected only %q to remain after DeletePrefix, got %v", unrelated, remaining)
+	}
+}
+
+// TestListAndDeletePrefixHttp exercises the plain HTTP provider's List,
+// which falls back to scraping an HTML directory index since the test
+// server (like many static file servers) doesn't support WebDAV PROPFIND.
+func TestListAndDeletePrefixHttp(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	tmp, dirCleanup := testutils.TempDir(t, 0)
+	defer dirCleanup()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method == "PROPFIND" {
+			http.Error(w, "PROPFIND not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/" {
+			if r.Method != "GET" {
+				http.Error(w, "unsupported method "+r.Method, 400)
+				return
+			}
+			files, err := ioutil.ReadDir(tmp)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			for _, f := range files {
+				fmt.Fprintf(w, `<a href="%s">%s</a>`, f.Name(), f.Name())
+			}
+			return
+		}
+		localfile := filepath.Join(tmp, filepath.Base(r.URL.Path))
+		switch r.Method {
+		case "PUT":
+			f, err := os.Create(localfile)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			defer f.Close()
+			if _, err := io.Copy(f, r.Body); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		case "GET":
+			http.ServeFile(w, r, localfile)
+		case "DELETE":
+			if err := os.Remove(localfile); err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		default:
+			http.Error(w, "unsupported method "+r.Method, 400)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Http,
+		HttpPath: roachpb.ExportStorage_Http{BaseUri: srv.URL + "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const n = 5
+	const prefix = "backup-part-"
+	want := make([]string, n)
+	for i := range want {
+		name := fmt.Sprintf("%s%02d", prefix, i)
+		want[i] = name
+		w, err := s.Writer(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unrelated := "manifest"
+	w, err := s.Writer(ctx, unrelated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("not part of the backup")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.List(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %v, expected %v", got, want)
+	}
+
+	if err := s.DeletePrefix(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	remaining, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(remaining, []string{unrelated}) {
+		t.Fatalf("expected only %q to remain after DeletePrefix, got %v", unrelated, remaining)
+	}
+}
+
+// fakeS3ListServer serves just enough of the ListObjectsV2 API for
+// s3Storage.List to exercise its pagination, splitting names across
+// pageSize-sized pages via a continuation token.
+type fakeS3ListServer struct {
+	*httptest.Server
+	names    []string
+	pageSize int
+}
+
+func newFakeS3ListServer(t *testing.T, names []string, pageSize int) *fakeS3ListServer {
+	f := &fakeS3ListServer{names: names, pageSize: pageSize}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		q := r.URL.Query()
+		if r.Method != "GET" || q.Get("list-type") != "2" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		start := 0
+		if tok := q.Get("continuation-token"); tok != "" {
+			n, err := strconv.Atoi(tok)
+			if err != nil {
+				http.Error(w, "bad continuation token", http.StatusBadRequest)
+				return
+			}
+			start = n
+		}
+		end := start + f.pageSize
+		truncated := end < len(f.names)
+		if end > len(f.names) {
+			end = len(f.names)
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+		for _, n := range f.names[start:end] {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, n)
+		}
+		if truncated {
+			fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, end)
+		} else {
+			fmt.Fprint(w, `<IsTruncated>false</IsTruncated>`)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	return f
+}
+
+// TestListS3Paginates verifies that s3Storage.List follows every page of a
+// multi-page ListObjectsV2 response, rather than only returning the names
+// from the first page.
+func TestListS3Paginates(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const n = 7
+	const pageSize = 2
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("backup-part-%02d", i)
+	}
+
+	srv := newFakeS3ListServer(t, want, pageSize)
+	defer srv.Close()
+
+	oldPageSize := s3ListPageSize
+	s3ListPageSize = pageSize
+	defer func() { s3ListPageSize = oldPageSize }()
+
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_S3,
+		S3Config: &roachpb.ExportStorage_S3{
+			Bucket:           "bucket",
+			AccessKey:        "key",
+			Secret:           "secret",
+			Endpoint:         srv.URL,
+			S3ForcePathStyle: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %v, expected %v", got, want)
+	}
+}
+
+// fakeGCSListServer serves just enough of the GCS objects.list API for
+// gcsStorage.List to exercise its pagination, splitting names across
+// pageSize-sized pages via a page token.
+type fakeGCSListServer struct {
+	*httptest.Server
+	names    []string
+	pageSize int
+}
+
+func newFakeGCSListServer(t *testing.T, names []string, pageSize int) *fakeGCSListServer {
+	f := &fakeGCSListServer{names: names, pageSize: pageSize}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "GET" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		start := 0
+		if tok := r.URL.Query().Get("pageToken"); tok != "" {
+			n, err := strconv.Atoi(tok)
+			if err != nil {
+				http.Error(w, "bad page token", http.StatusBadRequest)
+				return
+			}
+			start = n
+		}
+		end := start + f.pageSize
+		truncated := end < len(f.names)
+		if end > len(f.names) {
+			end = len(f.names)
+		}
+		items := make([]string, 0, end-start)
+		for _, n := range f.names[start:end] {
+			items = append(items, fmt.Sprintf(`{"name": %q, "bucket": "bucket"}`, n))
+		}
+		resp := fmt.Sprintf(`{"kind": "storage#objects", "items": [%s]`, strings.Join(items, ","))
+		if truncated {
+			resp += fmt.Sprintf(`, "nextPageToken": "%d"`, end)
+		}
+		resp += `}`
+		fmt.Fprint(w, resp)
+	}))
+	return f
+}
+
+// TestListGCSPaginates verifies that gcsStorage.List follows every page of a
+// multi-page object listing, rather than only returning the names from the
+// first page.
+func TestListGCSPaginates(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const n = 7
+	const pageSize = 2
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("backup-part-%02d", i)
+	}
+
+	srv := newFakeGCSListServer(t, want, pageSize)
+	defer srv.Close()
+
+	oldPageSize := gcsListPageSize
+	gcsListPageSize = pageSize
+	defer func() { gcsListPageSize = oldPageSize }()
+
+	ctx := context.TODO()
+	client, err := storage.NewClient(ctx,
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithHTTPClient(srv.Client()),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gcsStorage{bucket: client.Bucket("bucket"), conf: &roachpb.ExportStorage_GCS{Bucket: "bucket"}}
+
+	got, err := g.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %v, expected %v", got, want)
+	}
+}
+
+// fakeAzureListServer serves just enough of the Azure List Blobs API for
+// azureStorage.List to exercise its pagination, splitting names across
+// pageSize-sized pages via a marker.
+type fakeAzureListServer struct {
+	*httptest.Server
+	names    []string
+	pageSize int
+}
+
+func newFakeAzureListServer(t *testing.T, names []string, pageSize int) *fakeAzureListServer {
+	f := &fakeAzureListServer{names: names, pageSize: pageSize}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		q := r.URL.Query()
+		if r.Method != "GET" || q.Get("comp") != "list" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		start := 0
+		if tok := q.Get("marker"); tok != "" {
+			n, err := strconv.Atoi(tok)
+			if err != nil {
+				http.Error(w, "bad marker", http.StatusBadRequest)
+				return
+			}
+			start = n
+		}
+		end := start + f.pageSize
+		truncated := end < len(f.names)
+		if end > len(f.names) {
+			end = len(f.names)
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+		for _, n := range f.names[start:end] {
+			fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><BlobType>BlockBlob</BlobType></Properties></Blob>`, n)
+		}
+		fmt.Fprint(w, `</Blobs>`)
+		if truncated {
+			fmt.Fprintf(w, `<NextMarker>%d</NextMarker>`, end)
+		}
+		fmt.Fprint(w, `</EnumerationResults>`)
+	}))
+	return f
+}
+
+// TestListAzurePaginates verifies that azureStorage.List follows every page
+// of a multi-page blob listing, rather than only returning the names from
+// the first page.
+func TestListAzurePaginates(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	const n = 7
+	const pageSize = 2
+	want := make([]string, n)
+	for i := range want {
+		want[i] = fmt.Sprintf("backup-part-%02d", i)
+	}
+
+	srv := newFakeAzureListServer(t, want, pageSize)
+	defer srv.Close()
+
+	oldPageSize := azureListPageSize
+	azureListPageSize = uint(pageSize)
+	defer func() { azureListPageSize = oldPageSize }()
+
+	const fakeAccountKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	client, err := azureblob.NewClient(
+		"account", fakeAccountKey, srv.Listener.Addr().String(), azureblob.DefaultAPIVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &azureStorage{client: client.GetBlobService(), container: "container"}
+
+	ctx := context.TODO()
+	got, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("List returned %v, expected %v", got, want)
+	}
+}
+
 func TestPutLocal(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -172,6 +1397,165 @@ func TestPutS3(t *testing.T) {
 	})
 }
 
+// TestPutS3SSE round-trips files through S3 with SSE-S3 and SSE-KMS,
+// verifying both that the upload/download succeeds and that MakeExportStorage
+// doesn't reject these modes for the provider that actually supports them.
+func TestPutS3SSE(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	s3Keys, err := s3gof3r.EnvKeys()
+	if err != nil {
+		s3Keys, err = s3gof3r.InstanceKeys()
+		if err != nil {
+			t.Skip("No AWS keys instance or env keys")
+		}
+	}
+	bucket := os.Getenv("AWS_S3_BUCKET")
+	if bucket == "" {
+		t.Skip("AWS_S3_BUCKET env var must be set")
+	}
+	kmsKeyID := os.Getenv("AWS_KMS_KEY_ID")
+
+	http.DefaultTransport.(*http.Transport).DisableKeepAlives = true
+
+	for _, enc := range []*roachpb.ExportStorageEncryption{
+		{Mode: roachpb.ExportStorageEncryption_SSE_S3},
+		{Mode: roachpb.ExportStorageEncryption_SSE_KMS, KMSKeyID: kmsKeyID},
+	} {
+		testExportToTarget(t, roachpb.ExportStorage{
+			Provider: roachpb.ExportStorageProvider_S3,
+			S3Config: &roachpb.ExportStorage_S3{
+				Bucket:    bucket,
+				Prefix:    "backup-test",
+				AccessKey: s3Keys.AccessKey,
+				Secret:    s3Keys.SecretKey,
+			},
+			Encryption: enc,
+		})
+	}
+}
+
+// TestPutGoogleCloudSSE round-trips a file through GCS with SSE-KMS (CMEK),
+// verifying both that the upload/download succeeds and that MakeExportStorage
+// accepts this mode for GoogleCloud.
+func TestPutGoogleCloudSSE(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	bucket := os.Getenv("GS_BUCKET")
+	kmsKeyID := os.Getenv("GS_KMS_KEY_NAME")
+	if bucket == "" || kmsKeyID == "" {
+		t.Skip("GS_BUCKET and GS_KMS_KEY_NAME env vars must be set")
+	}
+
+	http.DefaultTransport.(*http.Transport).DisableKeepAlives = true
+
+	testExportToTarget(t, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_GoogleCloud,
+		GoogleCloudConfig: &roachpb.ExportStorage_GCS{
+			Bucket: bucket,
+			Prefix: "backup-test",
+		},
+		Encryption: &roachpb.ExportStorageEncryption{
+			Mode:     roachpb.ExportStorageEncryption_SSE_KMS,
+			KMSKeyID: kmsKeyID,
+		},
+	})
+}
+
+// TestPutAzureSSE round-trips a file through Azure Storage with a
+// customer-provided key (requested as SSE_KMS with a raw Key, since Azure
+// has no KMS-key-ID concept), verifying both that the upload/download
+// succeeds and that MakeExportStorage accepts this mode for Azure.
+func TestPutAzureSSE(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	accountName := os.Getenv("AZURE_ACCOUNT_NAME")
+	accountKey := os.Getenv("AZURE_ACCOUNT_KEY")
+	if accountName == "" || accountKey == "" {
+		t.Skip("AZURE_ACCOUNT_NAME and AZURE_ACCOUNT_KEY env vars must be set")
+	}
+	bucket := os.Getenv("AZURE_CONTAINER")
+	if bucket == "" {
+		t.Skip("AZURE_CONTAINER env var must be set")
+	}
+
+	http.DefaultTransport.(*http.Transport).DisableKeepAlives = true
+
+	testExportToTarget(t, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_Azure,
+		AzureConfig: &roachpb.ExportStorage_Azure{
+			Container:   bucket,
+			Prefix:      "backup-test",
+			AccountName: accountName,
+			AccountKey:  accountKey,
+		},
+		Encryption: &roachpb.ExportStorageEncryption{
+			Mode: roachpb.ExportStorageEncryption_SSE_KMS,
+			Key:  []byte("0123456789abcdef0123456789abcdef"),
+		},
+	})
+}
+
+// BenchmarkPutFileS3Multipart measures the throughput of the parallel
+// multipart PutFile path against a real S3 bucket, configured with a small
+// part size so that even the benchmark's payload is split into many parts.
+func BenchmarkPutFileS3Multipart(b *testing.B) {
+	s3Keys, err := s3gof3r.EnvKeys()
+	if err != nil {
+		s3Keys, err = s3gof3r.InstanceKeys()
+		if err != nil {
+			b.Skip("No AWS keys instance or env keys")
+		}
+	}
+	bucket := os.Getenv("AWS_S3_BUCKET")
+	if bucket == "" {
+		b.Skip("AWS_S3_BUCKET env var must be set")
+	}
+
+	http.DefaultTransport.(*http.Transport).DisableKeepAlives = true
+
+	const size = 64 * 1024 * 1024 // 64MiB
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.TODO()
+	s, err := MakeExportStorage(ctx, roachpb.ExportStorage{
+		Provider: roachpb.ExportStorageProvider_S3,
+		S3Config: &roachpb.ExportStorage_S3{
+			Bucket:        bucket,
+			Prefix:        "backup-test",
+			AccessKey:     s3Keys.AccessKey,
+			Secret:        s3Keys.SecretKey,
+			PartSizeBytes: 8 * 1024 * 1024,
+			Concurrency:   8,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("benchmark-multipart-%d", i)
+		w, err := s.PutFile(ctx, name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(w.LocalFile(), content, 0666); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Finish(); err != nil {
+			b.Fatal(err)
+		}
+		if err := s.Delete(ctx, name); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestPutGoogleCloud(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 